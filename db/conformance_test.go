@@ -0,0 +1,286 @@
+/*
+ * Copyright 2011 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package db
+
+import (
+	"context"
+	"net"
+	"path/filepath"
+	"sort"
+	"testing"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// conformanceBackends builds every pushRawDatabase implementation under test.
+// redis/etcd are skipped (not failed) when nothing is listening on their
+// default port, since this suite is meant to run in CI next to real servers
+// as well as on a laptop with neither installed; bolt needs no external
+// service so it always runs.
+func conformanceBackends(t *testing.T) map[string]pushRawDatabase {
+	backends := make(map[string]pushRawDatabase)
+
+	boltDB, err := newPushBoltDB(&DatabaseConfig{
+		Engine: "bolt",
+		Name:   filepath.Join(t.TempDir(), "conformance.bolt.db"),
+	})
+	if err != nil {
+		t.Fatalf("newPushBoltDB: %v", err)
+	}
+	backends["bolt"] = boltDB
+
+	if dialable("127.0.0.1:6379") {
+		redisDB, err := newPushRedisDB(&DatabaseConfig{Engine: "redis", Host: "127.0.0.1", Port: 6379, Name: "9"})
+		if err != nil {
+			t.Fatalf("newPushRedisDB: %v", err)
+		}
+		backends["redis"] = redisDB
+	} else {
+		t.Log("no redis listening on 127.0.0.1:6379, skipping redis conformance")
+	}
+
+	if dialable("127.0.0.1:2379") {
+		etcdDB, err := newPushEtcdDB(&DatabaseConfig{Engine: "etcd", Host: "127.0.0.1", Port: 2379})
+		if err != nil {
+			t.Fatalf("newPushEtcdDB: %v", err)
+		}
+		backends["etcd"] = etcdDB
+	} else {
+		t.Log("no etcd listening on 127.0.0.1:2379, skipping etcd conformance")
+	}
+
+	return backends
+}
+
+func dialable(addr string) bool {
+	c, err := net.DialTimeout("tcp", addr, 200*time.Millisecond)
+	if err != nil {
+		return false
+	}
+	c.Close()
+	return true
+}
+
+// TestPushRawDatabaseConformance runs the same scenario against every
+// registered pushRawDatabase backend so the three implementations can never
+// quietly drift apart on what AddDeliveryPointToServiceSubscriber,
+// ScanAndRepair, etc. actually do. It exercises the subscriber/PSP mapping
+// methods directly, since those only ever deal in names; the
+// DeliveryPoint/PushServiceProvider blob methods are covered indirectly via
+// ScanAndRepair, which seeds and removes blobs through the backend-specific
+// raw writers below rather than through push.PushServiceManager (building a
+// real *push.DeliveryPoint needs a registered push service plugin, which is
+// out of scope for this package's tests).
+func TestPushRawDatabaseConformance(t *testing.T) {
+	for name, raw := range conformanceBackends(t) {
+		t.Run(name, func(t *testing.T) {
+			testSubscriberDeliveryPointMapping(t, raw)
+			testPushServiceProviderMapping(t, raw)
+			testScanAndRepair(t, raw)
+		})
+	}
+}
+
+func testSubscriberDeliveryPointMapping(t *testing.T, raw pushRawDatabase) {
+	ctx := context.Background()
+	const srv, sub, dp = "conformance-service", "conformance-subscriber", "conformance-dp"
+
+	if err := raw.AddDeliveryPointToServiceSubscriber(ctx, srv, sub, dp); err != nil {
+		t.Fatalf("AddDeliveryPointToServiceSubscriber: %v", err)
+	}
+	// Adding the same delivery point twice must not double the refcount that
+	// later drives ScanAndRepair/removal; see chunk0-1's AddDeliveryPointToServiceSubscriberScript.
+	if err := raw.AddDeliveryPointToServiceSubscriber(ctx, srv, sub, dp); err != nil {
+		t.Fatalf("AddDeliveryPointToServiceSubscriber (repeat): %v", err)
+	}
+
+	got, err := raw.GetDeliveryPointsNameByServiceSubscriber(ctx, srv, sub)
+	if err != nil {
+		t.Fatalf("GetDeliveryPointsNameByServiceSubscriber: %v", err)
+	}
+	// Grouped by service, not subscriber: all three backends must agree with
+	// the Redis backend's elem[1]=service keying (pushredisdb.go), or a
+	// caller enumerating subscribers for a service gets a different shape
+	// depending on which backend answered it.
+	assertGroupedUnder(t, got, srv, dp)
+
+	wildcard, err := raw.GetDeliveryPointsNameByServiceSubscriber(ctx, srv, "*")
+	if err != nil {
+		t.Fatalf("GetDeliveryPointsNameByServiceSubscriber with wildcard: %v", err)
+	}
+	assertGroupedUnder(t, wildcard, srv, dp)
+
+	if err := raw.RemoveDeliveryPointFromServiceSubscriber(ctx, srv, sub, dp); err != nil {
+		t.Fatalf("RemoveDeliveryPointFromServiceSubscriber: %v", err)
+	}
+	got, err = raw.GetDeliveryPointsNameByServiceSubscriber(ctx, srv, sub)
+	if err != nil {
+		t.Fatalf("GetDeliveryPointsNameByServiceSubscriber after remove: %v", err)
+	}
+	if contains(got[srv], dp) {
+		t.Fatalf("GetDeliveryPointsNameByServiceSubscriber(%q, %q) = %v, want no %q after removal", srv, sub, got, dp)
+	}
+}
+
+// assertGroupedUnder fails unless m has exactly one entry, keyed by wantKey,
+// whose delivery point list contains wantDP. A backend that groups by
+// subscriber instead of service (or vice versa) fails this on the key
+// lookup, not just the containment check.
+func assertGroupedUnder(t *testing.T, m map[string][]string, wantKey, wantDP string) {
+	t.Helper()
+	if len(m) != 1 {
+		t.Fatalf("result has %d group(s) %v, want exactly 1 keyed by %q", len(m), keysOf(m), wantKey)
+	}
+	dps, ok := m[wantKey]
+	if !ok {
+		t.Fatalf("result keyed by %v, want key %q (service), got a different grouping — backends must key identically", keysOf(m), wantKey)
+	}
+	if !contains(dps, wantDP) {
+		t.Fatalf("result[%q] = %v, want to contain %q", wantKey, dps, wantDP)
+	}
+}
+
+func keysOf(m map[string][]string) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func testPushServiceProviderMapping(t *testing.T, raw pushRawDatabase) {
+	ctx := context.Background()
+	const srv, dp, psp = "conformance-service", "conformance-dp", "conformance-psp"
+
+	if err := raw.AddPushServiceProviderToService(ctx, srv, psp); err != nil {
+		t.Fatalf("AddPushServiceProviderToService: %v", err)
+	}
+	if err := raw.SetPushServiceProviderOfServiceDeliveryPoint(ctx, srv, dp, psp); err != nil {
+		t.Fatalf("SetPushServiceProviderOfServiceDeliveryPoint: %v", err)
+	}
+
+	got, err := raw.GetPushServiceProviderNameByServiceDeliveryPoint(ctx, srv, dp)
+	if err != nil {
+		t.Fatalf("GetPushServiceProviderNameByServiceDeliveryPoint: %v", err)
+	}
+	if got != psp {
+		t.Fatalf("GetPushServiceProviderNameByServiceDeliveryPoint = %q, want %q", got, psp)
+	}
+
+	psps, err := raw.GetPushServiceProvidersByService(ctx, srv)
+	if err != nil {
+		t.Fatalf("GetPushServiceProvidersByService: %v", err)
+	}
+	if !contains(psps, psp) {
+		t.Fatalf("GetPushServiceProvidersByService(%q) = %v, want to contain %q", srv, psps, psp)
+	}
+
+	if err := raw.RemovePushServiceProviderOfServiceDeliveryPoint(ctx, srv, dp); err != nil {
+		t.Fatalf("RemovePushServiceProviderOfServiceDeliveryPoint: %v", err)
+	}
+	got, err = raw.GetPushServiceProviderNameByServiceDeliveryPoint(ctx, srv, dp)
+	if err != nil {
+		t.Fatalf("GetPushServiceProviderNameByServiceDeliveryPoint after remove: %v", err)
+	}
+	if got != "" {
+		t.Fatalf("GetPushServiceProviderNameByServiceDeliveryPoint after remove = %q, want empty", got)
+	}
+
+	if err := raw.RemovePushServiceProviderFromService(ctx, srv, psp); err != nil {
+		t.Fatalf("RemovePushServiceProviderFromService: %v", err)
+	}
+	psps, err = raw.GetPushServiceProvidersByService(ctx, srv)
+	if err != nil {
+		t.Fatalf("GetPushServiceProvidersByService after remove: %v", err)
+	}
+	if contains(psps, psp) {
+		t.Fatalf("GetPushServiceProvidersByService(%q) = %v, want no %q after removal", srv, psps, psp)
+	}
+}
+
+func contains(haystack []string, needle string) bool {
+	for _, s := range haystack {
+		if s == needle {
+			return true
+		}
+	}
+	return false
+}
+
+// testScanAndRepair seeds one (service, subscriber) set with a delivery
+// point whose blob exists and one whose blob is missing, then checks that
+// ScanAndRepair removes only the orphan, leaving the healthy entry alone.
+func testScanAndRepair(t *testing.T, raw pushRawDatabase) {
+	ctx := context.Background()
+	const srv, sub = "conformance-repair-service", "conformance-repair-subscriber"
+	const healthyDP, orphanDP = "conformance-repair-healthy", "conformance-repair-orphan"
+
+	if err := raw.AddDeliveryPointToServiceSubscriber(ctx, srv, sub, healthyDP); err != nil {
+		t.Fatalf("AddDeliveryPointToServiceSubscriber(healthy): %v", err)
+	}
+	if err := raw.AddDeliveryPointToServiceSubscriber(ctx, srv, sub, orphanDP); err != nil {
+		t.Fatalf("AddDeliveryPointToServiceSubscriber(orphan): %v", err)
+	}
+	putRawDeliveryPointBlob(t, raw, healthyDP, []byte(`{"conformance":true}`))
+	// orphanDP deliberately has no blob, simulating the crash window between
+	// the SREM and the DEL that ScanAndRepair (chunk0-2) exists to close.
+
+	if err := raw.ScanAndRepair(ctx); err != nil {
+		t.Fatalf("ScanAndRepair: %v", err)
+	}
+
+	got, err := raw.GetDeliveryPointsNameByServiceSubscriber(ctx, srv, sub)
+	if err != nil {
+		t.Fatalf("GetDeliveryPointsNameByServiceSubscriber after repair: %v", err)
+	}
+	if !contains(got[srv], healthyDP) {
+		t.Fatalf("ScanAndRepair removed the healthy delivery point %q: %v", healthyDP, got)
+	}
+	if contains(got[srv], orphanDP) {
+		t.Fatalf("ScanAndRepair left the orphaned delivery point %q in place: %v", orphanDP, got)
+	}
+}
+
+// putRawDeliveryPointBlob writes directly to the backend's storage, bypassing
+// push.PushServiceManager parsing, so ScanAndRepair has something to treat as
+// a "blob present" delivery point without needing a registered push service
+// plugin.
+func putRawDeliveryPointBlob(t *testing.T, raw pushRawDatabase, name string, value []byte) {
+	ctx := context.Background()
+	switch backend := raw.(type) {
+	case *PushBoltDB:
+		err := backend.db.Update(func(tx *bolt.Tx) error {
+			return tx.Bucket(deliveryPointsBucket).Put([]byte(name), value)
+		})
+		if err != nil {
+			t.Fatalf("putRawDeliveryPointBlob(bolt): %v", err)
+		}
+	case *PushEtcdDB:
+		if _, err := backend.client.Put(ctx, deliveryPointKey(name), string(value)); err != nil {
+			t.Fatalf("putRawDeliveryPointBlob(etcd): %v", err)
+		}
+	case *PushRedisDB:
+		if err := backend.client.Set(ctx, deliveryPointKey(name), value, 0).Err(); err != nil {
+			t.Fatalf("putRawDeliveryPointBlob(redis): %v", err)
+		}
+	default:
+		t.Fatalf("putRawDeliveryPointBlob: unsupported backend %T", raw)
+	}
+}
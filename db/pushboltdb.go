@@ -0,0 +1,479 @@
+/*
+ * Copyright 2011 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package db
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"path"
+	"strconv"
+	"strings"
+
+	bolt "go.etcd.io/bbolt"
+
+	"github.com/uniqush/log"
+	"github.com/uniqush/uniqush-push/push"
+)
+
+// PushBoltDB is an embedded, single-node pushRawDatabase backed by a local
+// BoltDB file. It trades the HA story of Redis/etcd for zero external
+// moving parts, which is the right trade for a small, single-instance
+// uniqush-push deployment.
+type PushBoltDB struct {
+	db     *bolt.DB
+	psm    *push.PushServiceManager
+	logger log.Logger
+
+	// compress and compressionThreshold gate the same opt-in gzip
+	// compression as the Redis backend; see
+	// deliveryPointToValue/pushServiceProviderToValue.
+	compress             bool
+	compressionThreshold int
+}
+
+var _ pushRawDatabase = &PushBoltDB{}
+
+// Each schema prefix gets its own bucket so the namespaces can never collide
+// the way they could if everything lived in one flat key space.
+var (
+	deliveryPointsBucket          = []byte(DELIVERY_POINT_PREFIX)
+	pushServiceProvidersBucket    = []byte(PUSH_SERVICE_PROVIDER_PREFIX)
+	subscriberToDeliveryPointsBkt = []byte(SERVICE_SUBSCRIBER_TO_DELIVERY_POINTS_PREFIX)
+	deliveryPointToPSPBucket      = []byte(SERVICE_DELIVERY_POINT_TO_PUSH_SERVICE_PROVIDER_PREFIX)
+	serviceToPSPsBucket           = []byte(SERVICE_TO_PUSH_SERVICE_PROVIDERS_PREFIX)
+	deliveryPointCountersBucket   = []byte(DELIVERY_POINT_COUNTER_PREFIX)
+	allBoltBuckets                = [][]byte{
+		deliveryPointsBucket,
+		pushServiceProvidersBucket,
+		subscriberToDeliveryPointsBkt,
+		deliveryPointToPSPBucket,
+		serviceToPSPsBucket,
+		deliveryPointCountersBucket,
+	}
+)
+
+func newPushBoltDB(c *DatabaseConfig) (*PushBoltDB, error) {
+	if c == nil {
+		return nil, errors.New("Invalid Database Config")
+	}
+	if strings.ToLower(c.Engine) != "bolt" {
+		return nil, errors.New("Unsupported Database Engine")
+	}
+	path := c.Name
+	if path == "" {
+		path = "uniqush-push.bolt.db"
+	}
+
+	db, err := bolt.Open(path, 0600, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open bolt db %q: %v", path, err)
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, b := range allBoltBuckets {
+			if _, err := tx.CreateBucketIfNotExists(b); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to create bolt buckets: %v", err)
+	}
+
+	ret := new(PushBoltDB)
+	ret.db = db
+	ret.psm = c.PushServiceManager
+	if ret.psm == nil {
+		ret.psm = push.GetPushServiceManager()
+	}
+	ret.logger = c.Logger
+	if ret.logger == nil {
+		ret.logger = log.NewLogger(ioutil.Discard, "", 0)
+	}
+	ret.compress = c.Compression
+	ret.compressionThreshold = c.CompressionThreshold
+	return ret, nil
+}
+
+// setMember serializes a string set as newline-joined members. Bolt has no
+// native set type, so every set-valued bucket in this backend stores its
+// members this way.
+func encodeSet(members map[string]bool) []byte {
+	names := make([]string, 0, len(members))
+	for m := range members {
+		names = append(names, m)
+	}
+	return []byte(strings.Join(names, "\n"))
+}
+
+func decodeSet(raw []byte) map[string]bool {
+	members := make(map[string]bool)
+	if len(raw) == 0 {
+		return members
+	}
+	for _, m := range strings.Split(string(raw), "\n") {
+		if m != "" {
+			members[m] = true
+		}
+	}
+	return members
+}
+
+func (r *PushBoltDB) GetDeliveryPoint(ctx context.Context, name string) (*push.DeliveryPoint, error) {
+	var b []byte
+	err := r.db.View(func(tx *bolt.Tx) error {
+		v := tx.Bucket(deliveryPointsBucket).Get([]byte(name))
+		if v != nil {
+			b = append([]byte(nil), v...)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("GetDeliveryPoint failed: %v", err)
+	}
+	if b == nil {
+		return nil, nil
+	}
+	b, err = maybeDecompress(b)
+	if err != nil {
+		return nil, err
+	}
+	dp, err := r.psm.BuildDeliveryPointFromBytes(b)
+	if err != nil {
+		return nil, err
+	}
+	return dp, nil
+}
+
+func (r *PushBoltDB) SetDeliveryPoint(ctx context.Context, dp *push.DeliveryPoint) error {
+	return r.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(deliveryPointsBucket).Put([]byte(dp.Name()), deliveryPointToValue(dp, r.compress, r.compressionThreshold))
+	})
+}
+
+func (r *PushBoltDB) GetPushServiceProvider(ctx context.Context, name string) (*push.PushServiceProvider, error) {
+	var b []byte
+	err := r.db.View(func(tx *bolt.Tx) error {
+		v := tx.Bucket(pushServiceProvidersBucket).Get([]byte(name))
+		if v != nil {
+			b = append([]byte(nil), v...)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("GetPushServiceProvider failed: %v", err)
+	}
+	if b == nil {
+		return nil, nil
+	}
+	b, err = maybeDecompress(b)
+	if err != nil {
+		return nil, err
+	}
+	psp, err := r.psm.BuildPushServiceProviderFromBytes(b)
+	if err != nil {
+		return nil, err
+	}
+	return psp, nil
+}
+
+func (r *PushBoltDB) SetPushServiceProvider(ctx context.Context, psp *push.PushServiceProvider) error {
+	err := r.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(pushServiceProvidersBucket).Put([]byte(psp.Name()), pushServiceProviderToValue(psp, r.compress, r.compressionThreshold))
+	})
+	if err != nil {
+		return fmt.Errorf("SetPushServiceProvider %q failed: %v", psp.Name(), err)
+	}
+	return nil
+}
+
+func (r *PushBoltDB) RemoveDeliveryPoint(ctx context.Context, dp string) error {
+	err := r.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(deliveryPointsBucket).Delete([]byte(dp))
+	})
+	if err != nil {
+		return fmt.Errorf("RemoveDP %q failed: %v", dp, err)
+	}
+	return nil
+}
+
+func (r *PushBoltDB) RemovePushServiceProvider(ctx context.Context, psp string) error {
+	err := r.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(pushServiceProvidersBucket).Delete([]byte(psp))
+	})
+	if err != nil {
+		return fmt.Errorf("RemovePSP %q failed: %v", psp, err)
+	}
+	return nil
+}
+
+// GetDeliveryPointsNameByServiceSubscriber honors "*" wildcards in srv/usr the
+// same way the Redis backend's KEYS-based lookup does, matching stored keys
+// with path.Match instead of an exact Get, so REST endpoints that enumerate
+// subscribers with a wildcard behave the same regardless of backend. Like the
+// Redis backend, the returned map is keyed by the matched key's service
+// segment, not its subscriber segment.
+func (r *PushBoltDB) GetDeliveryPointsNameByServiceSubscriber(ctx context.Context, srv, usr string) (map[string][]string, error) {
+	ret := make(map[string][]string, 1)
+	err := r.db.View(func(tx *bolt.Tx) error {
+		bkt := tx.Bucket(subscriberToDeliveryPointsBkt)
+		var keys [][]byte
+		if !strings.Contains(srv, "*") && !strings.Contains(usr, "*") {
+			keys = [][]byte{[]byte(serviceSubscriberToDeliveryPointsKey(srv, usr))}
+		} else {
+			pattern := serviceSubscriberToDeliveryPointsKey(srv, usr)
+			if err := bkt.ForEach(func(k, _ []byte) error {
+				matched, err := path.Match(pattern, string(k))
+				if err != nil {
+					return fmt.Errorf("invalid wildcard pattern %q: %v", pattern, err)
+				}
+				if matched {
+					keys = append(keys, append([]byte(nil), k...))
+				}
+				return nil
+			}); err != nil {
+				return err
+			}
+		}
+
+		for _, k := range keys {
+			members := decodeSet(bkt.Get(k))
+			if len(members) == 0 {
+				continue
+			}
+			elem := strings.SplitN(strings.TrimPrefix(string(k), SERVICE_SUBSCRIBER_TO_DELIVERY_POINTS_PREFIX), ":", 2)
+			if len(elem) != 2 {
+				continue
+			}
+			dpl := make([]string, 0, len(members))
+			for m := range members {
+				dpl = append(dpl, m)
+			}
+			ret[elem[0]] = append(ret[elem[0]], dpl...)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("GetDPsNameByServiceSubscriber failed for \"%s:%s\": %v", srv, usr, err)
+	}
+	return ret, nil
+}
+
+func (r *PushBoltDB) GetPushServiceProviderNameByServiceDeliveryPoint(ctx context.Context, srv, dp string) (string, error) {
+	var b []byte
+	err := r.db.View(func(tx *bolt.Tx) error {
+		v := tx.Bucket(deliveryPointToPSPBucket).Get([]byte(serviceDeliveryPointToPushServiceProviderKey(srv, dp)))
+		if v != nil {
+			b = append([]byte(nil), v...)
+		}
+		return nil
+	})
+	if err != nil {
+		return "", fmt.Errorf("GetPSPNameByServiceDP failed: %v", err)
+	}
+	return string(b), nil
+}
+
+// AddDeliveryPointToServiceSubscriber and RemoveDeliveryPointFromServiceSubscriber
+// run inside a single bolt.Tx, which is how this backend gets the same
+// atomicity that the Redis backend gets from its Lua scripts: either every
+// bucket write in the transaction lands, or none of them do.
+func (r *PushBoltDB) AddDeliveryPointToServiceSubscriber(ctx context.Context, srv, sub, dp string) error {
+	return r.db.Update(func(tx *bolt.Tx) error {
+		setBkt := tx.Bucket(subscriberToDeliveryPointsBkt)
+		key := []byte(serviceSubscriberToDeliveryPointsKey(srv, sub))
+		members := decodeSet(setBkt.Get(key))
+		if members[dp] {
+			return nil
+		}
+		members[dp] = true
+		if err := setBkt.Put(key, encodeSet(members)); err != nil {
+			return err
+		}
+		return incrCounter(tx, deliveryPointCountersBucket, deliveryPointCounterKey(dp), 1)
+	})
+}
+
+func (r *PushBoltDB) RemoveDeliveryPointFromServiceSubscriber(ctx context.Context, srv, sub, dp string) error {
+	return r.db.Update(func(tx *bolt.Tx) error {
+		setBkt := tx.Bucket(subscriberToDeliveryPointsBkt)
+		key := []byte(serviceSubscriberToDeliveryPointsKey(srv, sub))
+		members := decodeSet(setBkt.Get(key))
+		if !members[dp] {
+			return nil
+		}
+		delete(members, dp)
+		if err := setBkt.Put(key, encodeSet(members)); err != nil {
+			return err
+		}
+		count, err := incrCounter(tx, deliveryPointCountersBucket, deliveryPointCounterKey(dp), -1)
+		if err != nil {
+			return err
+		}
+		if count <= 0 {
+			if err := tx.Bucket(deliveryPointCountersBucket).Delete([]byte(deliveryPointCounterKey(dp))); err != nil {
+				return err
+			}
+			if err := tx.Bucket(deliveryPointsBucket).Delete([]byte(dp)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// incrCounter applies delta to the counter stored at key within bkt and
+// returns its new value, creating the counter at delta if it didn't exist.
+func incrCounter(tx *bolt.Tx, bkt []byte, key string, delta int) (int, error) {
+	b := tx.Bucket(bkt)
+	count := 0
+	if v := b.Get([]byte(key)); v != nil {
+		n, err := strconv.Atoi(string(v))
+		if err != nil {
+			return 0, fmt.Errorf("corrupt counter at %q: %v", key, err)
+		}
+		count = n
+	}
+	count += delta
+	if err := b.Put([]byte(key), []byte(strconv.Itoa(count))); err != nil {
+		return 0, err
+	}
+	return count, nil
+}
+
+func (r *PushBoltDB) removeMissingDeliveryPointFromServiceSubscriber(ctx context.Context, service, subscriber, dpName string, logger log.Logger) error {
+	if err := r.RemoveDeliveryPointFromServiceSubscriber(ctx, service, subscriber, dpName); err != nil {
+		return fmt.Errorf("repair of orphan delivery point %q for \"%s:%s\" failed: %v", dpName, service, subscriber, err)
+	}
+	logger.Infof("repaired orphan delivery point %q referenced by \"%s:%s\" (blob was missing)", dpName, service, subscriber)
+	return nil
+}
+
+func (r *PushBoltDB) ScanAndRepair(ctx context.Context) error {
+	type pending struct {
+		service, subscriber, dp string
+	}
+	var toRepair []pending
+
+	err := r.db.View(func(tx *bolt.Tx) error {
+		subBkt := tx.Bucket(subscriberToDeliveryPointsBkt)
+		dpBkt := tx.Bucket(deliveryPointsBucket)
+		return subBkt.ForEach(func(k, v []byte) error {
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			default:
+			}
+			elem := strings.SplitN(strings.TrimPrefix(string(k), SERVICE_SUBSCRIBER_TO_DELIVERY_POINTS_PREFIX), ":", 2)
+			if len(elem) != 2 {
+				r.logger.Errorf("ScanAndRepair skipping malformed key %q", k)
+				return nil
+			}
+			for m := range decodeSet(v) {
+				if dpBkt.Get([]byte(m)) == nil {
+					toRepair = append(toRepair, pending{elem[0], elem[1], m})
+				}
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		return fmt.Errorf("ScanAndRepair failed to list subscriber sets: %v", err)
+	}
+
+	for _, p := range toRepair {
+		if err := r.removeMissingDeliveryPointFromServiceSubscriber(ctx, p.service, p.subscriber, p.dp, r.logger); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (r *PushBoltDB) SetPushServiceProviderOfServiceDeliveryPoint(ctx context.Context, srv, dp, psp string) error {
+	return r.db.Update(func(tx *bolt.Tx) error {
+		if err := tx.Bucket(deliveryPointToPSPBucket).Put([]byte(serviceDeliveryPointToPushServiceProviderKey(srv, dp)), []byte(psp)); err != nil {
+			return err
+		}
+		setBkt := tx.Bucket(serviceToPSPsBucket)
+		key := []byte(serviceToPushServiceProvidersKey(srv))
+		members := decodeSet(setBkt.Get(key))
+		members[psp] = true
+		return setBkt.Put(key, encodeSet(members))
+	})
+}
+
+func (r *PushBoltDB) RemovePushServiceProviderOfServiceDeliveryPoint(ctx context.Context, srv, dp string) error {
+	err := r.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(deliveryPointToPSPBucket).Delete([]byte(serviceDeliveryPointToPushServiceProviderKey(srv, dp)))
+	})
+	if err != nil {
+		return fmt.Errorf("RemovePSPOfServiceDP failed for \"%s:%s\": %v", srv, dp, err)
+	}
+	return nil
+}
+
+func (r *PushBoltDB) GetPushServiceProvidersByService(ctx context.Context, srv string) ([]string, error) {
+	var ret []string
+	err := r.db.View(func(tx *bolt.Tx) error {
+		v := tx.Bucket(serviceToPSPsBucket).Get([]byte(serviceToPushServiceProvidersKey(srv)))
+		for m := range decodeSet(v) {
+			ret = append(ret, m)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("GetPSPsByService failed for %q: %v", srv, err)
+	}
+	return ret, nil
+}
+
+func (r *PushBoltDB) RemovePushServiceProviderFromService(ctx context.Context, srv, psp string) error {
+	err := r.db.Update(func(tx *bolt.Tx) error {
+		setBkt := tx.Bucket(serviceToPSPsBucket)
+		key := []byte(serviceToPushServiceProvidersKey(srv))
+		members := decodeSet(setBkt.Get(key))
+		delete(members, psp)
+		return setBkt.Put(key, encodeSet(members))
+	})
+	if err != nil {
+		return fmt.Errorf("RemovePSPFromService failed for psp %q of service %q: %v", psp, srv, err)
+	}
+	return nil
+}
+
+func (r *PushBoltDB) AddPushServiceProviderToService(ctx context.Context, srv, psp string) error {
+	err := r.db.Update(func(tx *bolt.Tx) error {
+		setBkt := tx.Bucket(serviceToPSPsBucket)
+		key := []byte(serviceToPushServiceProvidersKey(srv))
+		members := decodeSet(setBkt.Get(key))
+		members[psp] = true
+		return setBkt.Put(key, encodeSet(members))
+	})
+	if err != nil {
+		return fmt.Errorf("AddPSPToService failed for psp %q of service %q: %v", psp, srv, err)
+	}
+	return nil
+}
+
+// FlushCache has nothing to flush: bolt fsyncs every committed transaction,
+// so there's no separate snapshot step the way there is with Redis SAVE.
+func (r *PushBoltDB) FlushCache(ctx context.Context) error {
+	return nil
+}
@@ -0,0 +1,419 @@
+/*
+ * Copyright 2011 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package db
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	clientv3 "go.etcd.io/etcd/client/v3"
+	"go.etcd.io/etcd/client/v3/concurrency"
+
+	"github.com/uniqush/log"
+	"github.com/uniqush/uniqush-push/push"
+)
+
+// PushEtcdDB is a pushRawDatabase backed by an etcd v3 cluster. It's the HA,
+// strongly-consistent alternative to Redis for operators who would rather
+// run etcd (which they may already run for other services) than stand up
+// Redis Sentinel or Cluster.
+type PushEtcdDB struct {
+	client  *clientv3.Client
+	session *concurrency.Session
+	psm     *push.PushServiceManager
+	logger  log.Logger
+
+	// compress and compressionThreshold gate the same opt-in gzip
+	// compression as the Redis backend; see
+	// deliveryPointToValue/pushServiceProviderToValue.
+	compress             bool
+	compressionThreshold int
+}
+
+var _ pushRawDatabase = &PushEtcdDB{}
+
+const defaultEtcdDialTimeout = 5 * time.Second
+
+func newPushEtcdDB(c *DatabaseConfig) (*PushEtcdDB, error) {
+	if c == nil {
+		return nil, errors.New("Invalid Database Config")
+	}
+	if strings.ToLower(c.Engine) != "etcd" {
+		return nil, errors.New("Unsupported Database Engine")
+	}
+	endpoints := c.ClusterAddrs
+	if len(endpoints) == 0 {
+		endpoints = []string{fmt.Sprintf("%s:%d", c.Host, c.Port)}
+	}
+
+	cli, err := clientv3.New(clientv3.Config{
+		Endpoints:   endpoints,
+		DialTimeout: defaultEtcdDialTimeout,
+		Username:    c.Name,
+		Password:    c.Password,
+		TLS:         c.TLSConfig,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to etcd: %v", err)
+	}
+	// A concurrency.Session backs the STM transactions below, which is how
+	// this backend gets the same read-modify-write atomicity that the Redis
+	// backend gets from EVAL and the bolt backend gets from bolt.Tx.
+	sess, err := concurrency.NewSession(cli)
+	if err != nil {
+		cli.Close()
+		return nil, fmt.Errorf("failed to create etcd session: %v", err)
+	}
+
+	ret := new(PushEtcdDB)
+	ret.client = cli
+	ret.session = sess
+	ret.psm = c.PushServiceManager
+	if ret.psm == nil {
+		ret.psm = push.GetPushServiceManager()
+	}
+	ret.logger = c.Logger
+	if ret.logger == nil {
+		ret.logger = log.NewLogger(ioutil.Discard, "", 0)
+	}
+	ret.compress = c.Compression
+	ret.compressionThreshold = c.CompressionThreshold
+	return ret, nil
+}
+
+func (r *PushEtcdDB) GetDeliveryPoint(ctx context.Context, name string) (*push.DeliveryPoint, error) {
+	resp, err := r.client.Get(ctx, deliveryPointKey(name))
+	if err != nil {
+		return nil, fmt.Errorf("GetDeliveryPoint failed: %v", err)
+	}
+	if len(resp.Kvs) == 0 {
+		return nil, nil
+	}
+	value, err := maybeDecompress(resp.Kvs[0].Value)
+	if err != nil {
+		return nil, err
+	}
+	return r.psm.BuildDeliveryPointFromBytes(value)
+}
+
+func (r *PushEtcdDB) SetDeliveryPoint(ctx context.Context, dp *push.DeliveryPoint) error {
+	_, err := r.client.Put(ctx, deliveryPointKey(dp.Name()), string(deliveryPointToValue(dp, r.compress, r.compressionThreshold)))
+	return err
+}
+
+func (r *PushEtcdDB) GetPushServiceProvider(ctx context.Context, name string) (*push.PushServiceProvider, error) {
+	resp, err := r.client.Get(ctx, pushServiceProviderKey(name))
+	if err != nil {
+		return nil, fmt.Errorf("GetPushServiceProvider failed: %v", err)
+	}
+	if len(resp.Kvs) == 0 {
+		return nil, nil
+	}
+	value, err := maybeDecompress(resp.Kvs[0].Value)
+	if err != nil {
+		return nil, err
+	}
+	return r.psm.BuildPushServiceProviderFromBytes(value)
+}
+
+func (r *PushEtcdDB) SetPushServiceProvider(ctx context.Context, psp *push.PushServiceProvider) error {
+	_, err := r.client.Put(ctx, pushServiceProviderKey(psp.Name()), string(pushServiceProviderToValue(psp, r.compress, r.compressionThreshold)))
+	if err != nil {
+		return fmt.Errorf("SetPushServiceProvider %q failed: %v", psp.Name(), err)
+	}
+	return nil
+}
+
+func (r *PushEtcdDB) RemoveDeliveryPoint(ctx context.Context, dp string) error {
+	_, err := r.client.Delete(ctx, deliveryPointKey(dp))
+	if err != nil {
+		return fmt.Errorf("RemoveDP %q failed: %v", dp, err)
+	}
+	return nil
+}
+
+func (r *PushEtcdDB) RemovePushServiceProvider(ctx context.Context, psp string) error {
+	_, err := r.client.Delete(ctx, pushServiceProviderKey(psp))
+	if err != nil {
+		return fmt.Errorf("RemovePSP %q failed: %v", psp, err)
+	}
+	return nil
+}
+
+// GetDeliveryPointsNameByServiceSubscriber honors "*" wildcards in srv/usr the
+// same way the Redis backend's KEYS-based lookup does: a WithPrefix scan of
+// the subscriber-set namespace filtered with path.Match, so REST endpoints
+// that enumerate subscribers with a wildcard behave the same regardless of
+// backend. Like the Redis backend, the returned map is keyed by the matched
+// key's service segment, not its subscriber segment.
+func (r *PushEtcdDB) GetDeliveryPointsNameByServiceSubscriber(ctx context.Context, srv, usr string) (map[string][]string, error) {
+	ret := make(map[string][]string, 1)
+	if !strings.Contains(srv, "*") && !strings.Contains(usr, "*") {
+		resp, err := r.client.Get(ctx, serviceSubscriberToDeliveryPointsKey(srv, usr))
+		if err != nil {
+			return nil, fmt.Errorf("GetDPsNameByServiceSubscriber failed for \"%s:%s\": %v", srv, usr, err)
+		}
+		if len(resp.Kvs) == 0 {
+			return ret, nil
+		}
+		members := decodeSet(resp.Kvs[0].Value)
+		if len(members) == 0 {
+			return ret, nil
+		}
+		dpl := make([]string, 0, len(members))
+		for m := range members {
+			dpl = append(dpl, m)
+		}
+		ret[srv] = dpl
+		return ret, nil
+	}
+
+	pattern := serviceSubscriberToDeliveryPointsKey(srv, usr)
+	resp, err := r.client.Get(ctx, SERVICE_SUBSCRIBER_TO_DELIVERY_POINTS_PREFIX, clientv3.WithPrefix())
+	if err != nil {
+		return nil, fmt.Errorf("GetDPsNameByServiceSubscriber failed for \"%s:%s\": %v", srv, usr, err)
+	}
+	for _, kv := range resp.Kvs {
+		matched, err := path.Match(pattern, string(kv.Key))
+		if err != nil {
+			return nil, fmt.Errorf("GetDPsNameByServiceSubscriber invalid wildcard pattern %q: %v", pattern, err)
+		}
+		if !matched {
+			continue
+		}
+		elem := strings.SplitN(strings.TrimPrefix(string(kv.Key), SERVICE_SUBSCRIBER_TO_DELIVERY_POINTS_PREFIX), ":", 2)
+		if len(elem) != 2 {
+			continue
+		}
+		members := decodeSet(kv.Value)
+		if len(members) == 0 {
+			continue
+		}
+		dpl := make([]string, 0, len(members))
+		for m := range members {
+			dpl = append(dpl, m)
+		}
+		ret[elem[0]] = append(ret[elem[0]], dpl...)
+	}
+	return ret, nil
+}
+
+func (r *PushEtcdDB) GetPushServiceProviderNameByServiceDeliveryPoint(ctx context.Context, srv, dp string) (string, error) {
+	resp, err := r.client.Get(ctx, serviceDeliveryPointToPushServiceProviderKey(srv, dp))
+	if err != nil {
+		return "", fmt.Errorf("GetPSPNameByServiceDP failed: %v", err)
+	}
+	if len(resp.Kvs) == 0 {
+		return "", nil
+	}
+	return string(resp.Kvs[0].Value), nil
+}
+
+// runSTM wraps concurrency.NewSTM so every read-modify-write across the two
+// keys that AddDeliveryPointToServiceSubscriber/
+// RemoveDeliveryPointFromServiceSubscriber/
+// SetPushServiceProviderOfServiceDeliveryPoint touch commits as a single
+// optimistic transaction, retrying automatically if another client raced it.
+func (r *PushEtcdDB) runSTM(ctx context.Context, apply func(s concurrency.STM) error) error {
+	_, err := concurrency.NewSTM(r.client, apply, concurrency.WithAbortContext(ctx))
+	return err
+}
+
+func (r *PushEtcdDB) AddDeliveryPointToServiceSubscriber(ctx context.Context, srv, sub, dp string) error {
+	setKey := serviceSubscriberToDeliveryPointsKey(srv, sub)
+	counterKey := deliveryPointCounterKey(dp)
+	err := r.runSTM(ctx, func(s concurrency.STM) error {
+		members := decodeSet([]byte(s.Get(setKey)))
+		if members[dp] {
+			return nil
+		}
+		members[dp] = true
+		s.Put(setKey, string(encodeSet(members)))
+		count := 0
+		if v := s.Get(counterKey); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil {
+				return fmt.Errorf("corrupt counter at %q: %v", counterKey, err)
+			}
+			count = n
+		}
+		s.Put(counterKey, strconv.Itoa(count+1))
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("AddDPToServiceSubscriber failed: %v", err)
+	}
+	return nil
+}
+
+func (r *PushEtcdDB) RemoveDeliveryPointFromServiceSubscriber(ctx context.Context, srv, sub, dp string) error {
+	setKey := serviceSubscriberToDeliveryPointsKey(srv, sub)
+	counterKey := deliveryPointCounterKey(dp)
+	err := r.runSTM(ctx, func(s concurrency.STM) error {
+		members := decodeSet([]byte(s.Get(setKey)))
+		if !members[dp] {
+			return nil
+		}
+		delete(members, dp)
+		s.Put(setKey, string(encodeSet(members)))
+
+		count := 0
+		if v := s.Get(counterKey); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil {
+				return fmt.Errorf("corrupt counter at %q: %v", counterKey, err)
+			}
+			count = n
+		}
+		count--
+		if count <= 0 {
+			s.Del(counterKey)
+			s.Del(deliveryPointKey(dp))
+		} else {
+			s.Put(counterKey, strconv.Itoa(count))
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("Removing the delivery point pointer %q from \"%s:%s\" failed: %v", dp, srv, sub, err)
+	}
+	return nil
+}
+
+func (r *PushEtcdDB) removeMissingDeliveryPointFromServiceSubscriber(ctx context.Context, service, subscriber, dpName string, logger log.Logger) error {
+	if err := r.RemoveDeliveryPointFromServiceSubscriber(ctx, service, subscriber, dpName); err != nil {
+		return fmt.Errorf("repair of orphan delivery point %q for \"%s:%s\" failed: %v", dpName, service, subscriber, err)
+	}
+	logger.Infof("repaired orphan delivery point %q referenced by \"%s:%s\" (blob was missing)", dpName, service, subscriber)
+	return nil
+}
+
+func (r *PushEtcdDB) ScanAndRepair(ctx context.Context) error {
+	resp, err := r.client.Get(ctx, SERVICE_SUBSCRIBER_TO_DELIVERY_POINTS_PREFIX, clientv3.WithPrefix())
+	if err != nil {
+		return fmt.Errorf("ScanAndRepair failed to list subscriber sets: %v", err)
+	}
+	for _, kv := range resp.Kvs {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		default:
+		}
+
+		elem := strings.SplitN(strings.TrimPrefix(string(kv.Key), SERVICE_SUBSCRIBER_TO_DELIVERY_POINTS_PREFIX), ":", 2)
+		if len(elem) != 2 {
+			r.logger.Errorf("ScanAndRepair skipping malformed key %q", kv.Key)
+			continue
+		}
+		service, subscriber := elem[0], elem[1]
+
+		for m := range decodeSet(kv.Value) {
+			dpResp, err := r.client.Get(ctx, deliveryPointKey(m))
+			if err != nil {
+				return fmt.Errorf("ScanAndRepair lookup for %q failed: %v", m, err)
+			}
+			if len(dpResp.Kvs) > 0 {
+				continue
+			}
+			if err := r.removeMissingDeliveryPointFromServiceSubscriber(ctx, service, subscriber, m, r.logger); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (r *PushEtcdDB) SetPushServiceProviderOfServiceDeliveryPoint(ctx context.Context, srv, dp, psp string) error {
+	dpKey := serviceDeliveryPointToPushServiceProviderKey(srv, dp)
+	setKey := serviceToPushServiceProvidersKey(srv)
+	err := r.runSTM(ctx, func(s concurrency.STM) error {
+		s.Put(dpKey, psp)
+		members := decodeSet([]byte(s.Get(setKey)))
+		members[psp] = true
+		s.Put(setKey, string(encodeSet(members)))
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("SetPSPOfServiceDP failed for \"%s:%s\": %v", srv, dp, err)
+	}
+	return nil
+}
+
+func (r *PushEtcdDB) RemovePushServiceProviderOfServiceDeliveryPoint(ctx context.Context, srv, dp string) error {
+	_, err := r.client.Delete(ctx, serviceDeliveryPointToPushServiceProviderKey(srv, dp))
+	if err != nil {
+		return fmt.Errorf("RemovePSPOfServiceDP failed for \"%s:%s\": %v", srv, dp, err)
+	}
+	return nil
+}
+
+func (r *PushEtcdDB) GetPushServiceProvidersByService(ctx context.Context, srv string) ([]string, error) {
+	resp, err := r.client.Get(ctx, serviceToPushServiceProvidersKey(srv))
+	if err != nil {
+		return nil, fmt.Errorf("GetPSPsByService failed for %q: %v", srv, err)
+	}
+	if len(resp.Kvs) == 0 {
+		return nil, nil
+	}
+	members := decodeSet(resp.Kvs[0].Value)
+	ret := make([]string, 0, len(members))
+	for m := range members {
+		ret = append(ret, m)
+	}
+	return ret, nil
+}
+
+func (r *PushEtcdDB) RemovePushServiceProviderFromService(ctx context.Context, srv, psp string) error {
+	setKey := serviceToPushServiceProvidersKey(srv)
+	err := r.runSTM(ctx, func(s concurrency.STM) error {
+		members := decodeSet([]byte(s.Get(setKey)))
+		delete(members, psp)
+		s.Put(setKey, string(encodeSet(members)))
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("RemovePSPFromService failed for psp %q of service %q: %v", psp, srv, err)
+	}
+	return nil
+}
+
+func (r *PushEtcdDB) AddPushServiceProviderToService(ctx context.Context, srv, psp string) error {
+	setKey := serviceToPushServiceProvidersKey(srv)
+	err := r.runSTM(ctx, func(s concurrency.STM) error {
+		members := decodeSet([]byte(s.Get(setKey)))
+		members[psp] = true
+		s.Put(setKey, string(encodeSet(members)))
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("AddPSPToService failed for psp %q of service %q: %v", psp, srv, err)
+	}
+	return nil
+}
+
+// FlushCache is a no-op: etcd fsyncs every committed raft entry, so there's
+// no separate snapshot step the way there is with Redis SAVE.
+func (r *PushEtcdDB) FlushCache(ctx context.Context) error {
+	return nil
+}
@@ -18,31 +18,99 @@
 package db
 
 import (
+	"context"
 	"errors"
 	"fmt"
+	"io/ioutil"
 	"strconv"
 	"strings"
 
-	redis "github.com/monnand/goredis"
+	redis "github.com/redis/go-redis/v9"
+	"github.com/uniqush/log"
 	"github.com/uniqush/uniqush-push/push"
 )
 
 type PushRedisDB struct {
-	client *redis.Client
+	client redis.UniversalClient
 	psm    *push.PushServiceManager
+	logger log.Logger
+
+	// compress and compressionThreshold gate the opt-in gzip compression
+	// applied to delivery point and push service provider blobs; see
+	// deliveryPointToValue/pushServiceProviderToValue.
+	compress             bool
+	compressionThreshold int
+
+	// clusterMode is set when client was built from c.ClusterAddrs. The Lua
+	// scripts below address keys that belong to different logical entities
+	// (a per-subscriber set vs. a per-delivery-point counter/blob) and so
+	// cannot be made to share a hash slot without changing what those keys
+	// mean; see the comment on errClusterCrossSlot.
+	clusterMode bool
 }
 
 var _ pushRawDatabase = &PushRedisDB{}
 
+// errClusterCrossSlot is returned instead of attempting the EVAL calls below
+// against a Redis Cluster. Each script touches keys derived from unrelated
+// values (addDeliveryPointToServiceSubscriberScript and
+// removeDeliveryPointFromServiceSubscriberScript mix a (service,subscriber)
+// set key with a delivery-point-scoped counter/blob key; the PSP script mixes
+// a (service,deliveryPoint) key with a service-scoped set key), so there is
+// no hash tag that puts them in the same slot without also changing what the
+// keys address. Rather than let the server reject the EVAL with an opaque
+// CROSSSLOT error, callers get a clear, actionable one up front. Operators
+// who need Cluster should configure DatabaseConfig.SentinelAddrs/MasterName
+// (single-primary failover) instead of ClusterAddrs, or choose the bolt/etcd
+// backend from chunk0-5, both of which don't depend on key co-location.
+var errClusterCrossSlot = errors.New("this operation touches keys that cannot share a Redis Cluster hash slot; Cluster is not supported for subscriber/PSP mutations, use Sentinel or the bolt/etcd backend instead")
+
+// These Lua scripts let the SADD/SREM that tracks subscriber membership and
+// the INCR/DECR that maintains the refcount run as a single atomic unit on
+// the Redis server, so a dropped connection between the two commands can no
+// longer leave the counter and the subscriber set disagreeing with each
+// other. They are not Cluster-safe; see errClusterCrossSlot.
 const (
-	DELIVERY_POINT_PREFIX                                  string = "delivery.point:"         // STRING (prefix of)- Maps the delivery point name to a json blob of information about a delivery point.
-	PUSH_SERVICE_PROVIDER_PREFIX                           string = "push.service.provider:"  // STRING (prefix of) - Maps a push service provider name to a json blob of information about it.
-	SERVICE_SUBSCRIBER_TO_DELIVERY_POINTS_PREFIX           string = "srv.sub-2-dp:"           // SET (prefix of) - Maps a service name + subscriber to a set of delivery point names
-	SERVICE_DELIVERY_POINT_TO_PUSH_SERVICE_PROVIDER_PREFIX string = "srv.dp-2-psp:"           // STRING (prefix of) - Maps a service name + delivery point name to the push service provider
-	SERVICE_TO_PUSH_SERVICE_PROVIDERS_PREFIX               string = "srv-2-psp:"              // SET (prefix of) - Maps a service name to a set of PSP names
-	DELIVERY_POINT_COUNTER_PREFIX                          string = "delivery.point.counter:" // STRING (prefix of) - Maps a delivery point name to the number of subcribers(summed across each service).
+	// KEYS[1] = srv.sub-2-dp: set, KEYS[2] = delivery.point.counter:
+	// ARGV[1] = delivery point name
+	addDeliveryPointToServiceSubscriberScript = `
+local added = redis.call('SADD', KEYS[1], ARGV[1])
+if added == 1 then
+	redis.call('INCR', KEYS[2])
+end
+return added
+`
+
+	// KEYS[1] = srv.sub-2-dp: set, KEYS[2] = delivery.point.counter:,
+	// KEYS[3] = delivery.point: blob
+	// ARGV[1] = delivery point name
+	removeDeliveryPointFromServiceSubscriberScript = `
+local removed = redis.call('SREM', KEYS[1], ARGV[1])
+if removed == 0 then
+	return 0
+end
+local count = redis.call('DECR', KEYS[2])
+if count <= 0 then
+	redis.call('DEL', KEYS[2])
+	redis.call('DEL', KEYS[3])
+end
+return removed
+`
+
+	// KEYS[1] = srv.dp-2-psp: string, KEYS[2] = srv-2-psp: set
+	// ARGV[1] = push service provider name
+	setPushServiceProviderOfServiceDeliveryPointScript = `
+redis.call('SET', KEYS[1], ARGV[1])
+redis.call('SADD', KEYS[2], ARGV[1])
+return 1
+`
 )
 
+// newPushRedisDB builds a redis.UniversalClient, which transparently becomes
+// a plain pooled *redis.Client, a Sentinel-backed failover client, or a
+// ClusterClient depending on which of c.MasterName/c.SentinelAddrs/
+// c.ClusterAddrs are set. This is what gives operators HA deployments
+// without the db package having to know which topology it's talking to.
 func newPushRedisDB(c *DatabaseConfig) (*PushRedisDB, error) {
 	if c == nil {
 		return nil, errors.New("Invalid Database Config")
@@ -50,7 +118,6 @@ func newPushRedisDB(c *DatabaseConfig) (*PushRedisDB, error) {
 	if strings.ToLower(c.Engine) != "redis" {
 		return nil, errors.New("Unsupported Database Engine")
 	}
-	var client redis.Client
 	if c.Host == "" {
 		c.Host = "localhost"
 	}
@@ -60,25 +127,49 @@ func newPushRedisDB(c *DatabaseConfig) (*PushRedisDB, error) {
 	if c.Name == "" {
 		c.Name = "0"
 	}
-
-	client.Addr = fmt.Sprintf("%s:%d", c.Host, c.Port)
-	client.Password = c.Password
-	var err error
-	client.Db, err = strconv.Atoi(c.Name)
+	db, err := strconv.Atoi(c.Name)
 	if err != nil {
-		client.Db = 0
+		db = 0
+	}
+
+	opts := &redis.UniversalOptions{
+		DB:           db,
+		Password:     c.Password,
+		PoolSize:     c.PoolSize,
+		MinIdleConns: c.MinIdleConns,
+		TLSConfig:    c.TLSConfig,
+	}
+	switch {
+	case c.MasterName != "":
+		opts.MasterName = c.MasterName
+		opts.Addrs = c.SentinelAddrs
+	case len(c.ClusterAddrs) > 0:
+		opts.Addrs = c.ClusterAddrs
+	default:
+		opts.Addrs = []string{fmt.Sprintf("%s:%d", c.Host, c.Port)}
 	}
 
 	ret := new(PushRedisDB)
-	ret.client = &client
+	ret.client = redis.NewUniversalClient(opts)
 	ret.psm = c.PushServiceManager
 	if ret.psm == nil {
 		ret.psm = push.GetPushServiceManager()
 	}
+	ret.logger = c.Logger
+	if ret.logger == nil {
+		ret.logger = log.NewLogger(ioutil.Discard, "", 0)
+	}
+	ret.compress = c.Compression
+	ret.compressionThreshold = c.CompressionThreshold
+	ret.clusterMode = c.MasterName == "" && len(c.ClusterAddrs) > 0
 	return ret, nil
 }
 
 func (r *PushRedisDB) keyValueToDeliveryPoint(name string, value []byte) (dp *push.DeliveryPoint, err error) {
+	value, err = maybeDecompress(value)
+	if err != nil {
+		return nil, err
+	}
 	psm := r.psm
 	dp, err = psm.BuildDeliveryPointFromBytes(value)
 	if err != nil {
@@ -88,6 +179,10 @@ func (r *PushRedisDB) keyValueToDeliveryPoint(name string, value []byte) (dp *pu
 }
 
 func (r *PushRedisDB) keyValueToPushServiceProvider(name string, value []byte) (psp *push.PushServiceProvider, err error) {
+	value, err = maybeDecompress(value)
+	if err != nil {
+		return nil, err
+	}
 	psm := r.psm
 	psp, err = psm.BuildPushServiceProviderFromBytes(value)
 	if err != nil {
@@ -96,84 +191,95 @@ func (r *PushRedisDB) keyValueToPushServiceProvider(name string, value []byte) (
 	return
 }
 
-func deliveryPointToValue(dp *push.DeliveryPoint) []byte {
-	return dp.Marshal()
+// deliveryPointToValue and pushServiceProviderToValue gzip-compress the
+// marshaled blob when compress is set and it's bigger than threshold (see
+// maybeCompress), so large APNs/FCM credentials don't round-trip through
+// Redis at full size on every read. compress/threshold are 0/false for
+// backends that haven't opted in, which leaves the blob untouched.
+func deliveryPointToValue(dp *push.DeliveryPoint, compress bool, threshold int) []byte {
+	return maybeCompress(dp.Marshal(), compress, threshold)
 }
 
-func pushServiceProviderToValue(psp *push.PushServiceProvider) []byte {
-	return psp.Marshal()
+func pushServiceProviderToValue(psp *push.PushServiceProvider, compress bool, threshold int) []byte {
+	return maybeCompress(psp.Marshal(), compress, threshold)
 }
 
-func (r *PushRedisDB) mgetRawDeliveryPoints(deliveryPointNames ...string) ([][]byte, error) {
+// mgetRawDeliveryPoints fetches every delivery point blob in a single MGET
+// round trip rather than one GET per name.
+func (r *PushRedisDB) mgetRawDeliveryPoints(ctx context.Context, deliveryPointNames ...string) ([][]byte, error) {
 	var deliveryPointKeys []string
 	for _, deliveryPointName := range deliveryPointNames {
-		deliveryPointKeys = append(deliveryPointKeys, DELIVERY_POINT_PREFIX+deliveryPointName)
+		deliveryPointKeys = append(deliveryPointKeys, deliveryPointKey(deliveryPointName))
 	}
 
-	deliveryPointData, err := r.client.Mget(deliveryPointKeys...)
+	raw, err := r.client.MGet(ctx, deliveryPointKeys...).Result()
 	if err != nil {
 		return nil, fmt.Errorf("Error getting deliveryPointKeys: %v", err)
 	}
+	deliveryPointData := make([][]byte, len(raw))
+	for i, v := range raw {
+		if v == nil {
+			continue
+		}
+		deliveryPointData[i] = []byte(v.(string))
+	}
 	return deliveryPointData, nil
 }
 
-func (r *PushRedisDB) GetDeliveryPoint(name string) (*push.DeliveryPoint, error) {
-	b, err := r.client.Get(DELIVERY_POINT_PREFIX + name)
+func (r *PushRedisDB) GetDeliveryPoint(ctx context.Context, name string) (*push.DeliveryPoint, error) {
+	b, err := r.client.Get(ctx, deliveryPointKey(name)).Bytes()
+	if err == redis.Nil {
+		return nil, nil
+	}
 	if err != nil {
 		return nil, fmt.Errorf("GetDeliveryPoint failed: %v", err)
 	}
-	if b == nil {
-		return nil, nil
-	}
 	return r.keyValueToDeliveryPoint(name, b)
 }
 
-func (r *PushRedisDB) SetDeliveryPoint(dp *push.DeliveryPoint) error {
-	err := r.client.Set(DELIVERY_POINT_PREFIX+dp.Name(), deliveryPointToValue(dp))
-	return err
+func (r *PushRedisDB) SetDeliveryPoint(ctx context.Context, dp *push.DeliveryPoint) error {
+	return r.client.Set(ctx, deliveryPointKey(dp.Name()), deliveryPointToValue(dp, r.compress, r.compressionThreshold), 0).Err()
 }
 
-func (r *PushRedisDB) GetPushServiceProvider(name string) (*push.PushServiceProvider, error) {
-	b, err := r.client.Get(PUSH_SERVICE_PROVIDER_PREFIX + name)
+func (r *PushRedisDB) GetPushServiceProvider(ctx context.Context, name string) (*push.PushServiceProvider, error) {
+	b, err := r.client.Get(ctx, pushServiceProviderKey(name)).Bytes()
+	if err == redis.Nil {
+		return nil, nil
+	}
 	if err != nil {
 		return nil, fmt.Errorf("GetPushServiceProvider failed: %v", err)
 	}
-	if b == nil {
-		return nil, nil
-	}
 	return r.keyValueToPushServiceProvider(name, b)
 }
 
-func (r *PushRedisDB) SetPushServiceProvider(psp *push.PushServiceProvider) error {
-	if err := r.client.Set(PUSH_SERVICE_PROVIDER_PREFIX+psp.Name(), pushServiceProviderToValue(psp)); err != nil {
+func (r *PushRedisDB) SetPushServiceProvider(ctx context.Context, psp *push.PushServiceProvider) error {
+	if err := r.client.Set(ctx, pushServiceProviderKey(psp.Name()), pushServiceProviderToValue(psp, r.compress, r.compressionThreshold), 0).Err(); err != nil {
 		return fmt.Errorf("SetPushServiceProvider %q failed: %v", psp.Name(), err)
 	}
 	return nil
 }
 
-func (r *PushRedisDB) RemoveDeliveryPoint(dp string) error {
-	_, err := r.client.Del(DELIVERY_POINT_PREFIX + dp)
-	if err != nil {
+func (r *PushRedisDB) RemoveDeliveryPoint(ctx context.Context, dp string) error {
+	if err := r.client.Del(ctx, deliveryPointKey(dp)).Err(); err != nil {
 		return fmt.Errorf("RemoveDP %q failed: %v", dp, err)
 	}
 	return nil
 }
 
-func (r *PushRedisDB) RemovePushServiceProvider(psp string) error {
-	_, err := r.client.Del(PUSH_SERVICE_PROVIDER_PREFIX + psp)
-	if err != nil {
+func (r *PushRedisDB) RemovePushServiceProvider(ctx context.Context, psp string) error {
+	if err := r.client.Del(ctx, pushServiceProviderKey(psp)).Err(); err != nil {
 		return fmt.Errorf("RemovePSP %q failed: %v", psp, err)
 	}
 	return nil
 }
 
-func (r *PushRedisDB) GetDeliveryPointsNameByServiceSubscriber(srv, usr string) (map[string][]string, error) {
+func (r *PushRedisDB) GetDeliveryPointsNameByServiceSubscriber(ctx context.Context, srv, usr string) (map[string][]string, error) {
 	keys := make([]string, 1)
 	if !strings.Contains(usr, "*") && !strings.Contains(srv, "*") {
-		keys[0] = SERVICE_SUBSCRIBER_TO_DELIVERY_POINTS_PREFIX + srv + ":" + usr
+		keys[0] = serviceSubscriberToDeliveryPointsKey(srv, usr)
 	} else {
 		var err error
-		keys, err = r.client.Keys(SERVICE_SUBSCRIBER_TO_DELIVERY_POINTS_PREFIX + srv + ":" + usr)
+		keys, err = r.client.Keys(ctx, serviceSubscriberToDeliveryPointsKey(srv, usr)).Result()
 		if err != nil {
 			return nil, fmt.Errorf("GetDPsNameByServiceSubscriber dp lookup '%s:%s' failed: %v", srv, usr, err)
 		}
@@ -181,11 +287,11 @@ func (r *PushRedisDB) GetDeliveryPointsNameByServiceSubscriber(srv, usr string)
 
 	ret := make(map[string][]string, len(keys))
 	for _, k := range keys {
-		m, err := r.client.Smembers(k)
+		m, err := r.client.SMembers(ctx, k).Result()
 		if err != nil {
 			return nil, fmt.Errorf("GetDPsNameByServiceSubscriber smembers %q failed: %v", k, err)
 		}
-		if m == nil {
+		if len(m) == 0 {
 			continue
 		}
 		elem := strings.Split(k, ":")
@@ -193,114 +299,167 @@ func (r *PushRedisDB) GetDeliveryPointsNameByServiceSubscriber(srv, usr string)
 		if l, ok := ret[s]; !ok || l == nil {
 			ret[s] = make([]string, 0, len(keys))
 		}
-		for _, bm := range m {
-			dpl := ret[s]
-			dpl = append(dpl, string(bm))
-			ret[s] = dpl
-		}
+		ret[s] = append(ret[s], m...)
 	}
 	return ret, nil
 }
 
-func (r *PushRedisDB) GetPushServiceProviderNameByServiceDeliveryPoint(srv, dp string) (string, error) {
-	b, err := r.client.Get(SERVICE_DELIVERY_POINT_TO_PUSH_SERVICE_PROVIDER_PREFIX + srv + ":" + dp)
+func (r *PushRedisDB) GetPushServiceProviderNameByServiceDeliveryPoint(ctx context.Context, srv, dp string) (string, error) {
+	b, err := r.client.Get(ctx, serviceDeliveryPointToPushServiceProviderKey(srv, dp)).Result()
+	if err == redis.Nil {
+		return "", nil
+	}
 	if err != nil {
 		return "", fmt.Errorf("GetPSPNameByServiceDP failed: %v", err)
 	}
-	if b == nil {
-		return "", nil
-	}
-	return string(b), nil
+	return b, nil
 }
 
-func (r *PushRedisDB) AddDeliveryPointToServiceSubscriber(srv, sub, dp string) error {
-	i, err := r.client.Sadd(SERVICE_SUBSCRIBER_TO_DELIVERY_POINTS_PREFIX+srv+":"+sub, []byte(dp))
-	if err != nil {
-		return fmt.Errorf("AddDPToServiceSubscriber failed: %v", err)
+func (r *PushRedisDB) AddDeliveryPointToServiceSubscriber(ctx context.Context, srv, sub, dp string) error {
+	if r.clusterMode {
+		return errClusterCrossSlot
 	}
-	if i == false {
-		return nil
+	keys := []string{
+		serviceSubscriberToDeliveryPointsKey(srv, sub),
+		deliveryPointCounterKey(dp),
 	}
-	_, err = r.client.Incr(DELIVERY_POINT_COUNTER_PREFIX + dp)
-	if err != nil {
-		return fmt.Errorf("AddDPToServiceSubscriber count tracking failed: %v", err)
+	if err := r.client.Eval(ctx, addDeliveryPointToServiceSubscriberScript, keys, dp).Err(); err != nil {
+		return fmt.Errorf("AddDPToServiceSubscriber failed: %v", err)
 	}
 	return nil
 }
 
-func (r *PushRedisDB) RemoveDeliveryPointFromServiceSubscriber(srv, sub, dp string) error {
-	j, err := r.client.Srem(SERVICE_SUBSCRIBER_TO_DELIVERY_POINTS_PREFIX+srv+":"+sub, []byte(dp))
-	if err != nil {
-		return fmt.Errorf("Removing the delivery point pointer %q from \"%s:%s\" failed", dp, srv, sub)
+func (r *PushRedisDB) RemoveDeliveryPointFromServiceSubscriber(ctx context.Context, srv, sub, dp string) error {
+	if r.clusterMode {
+		return errClusterCrossSlot
+	}
+	keys := []string{
+		serviceSubscriberToDeliveryPointsKey(srv, sub),
+		deliveryPointCounterKey(dp),
+		deliveryPointKey(dp),
 	}
-	if j == false {
-		return nil
+	if err := r.client.Eval(ctx, removeDeliveryPointFromServiceSubscriberScript, keys, dp).Err(); err != nil {
+		return fmt.Errorf("Removing the delivery point pointer %q from \"%s:%s\" failed: %v", dp, srv, sub, err)
 	}
-	i, e := r.client.Decr(DELIVERY_POINT_COUNTER_PREFIX + dp)
-	if e != nil {
-		return fmt.Errorf("Failed to decrement number of subscribers using dp %q: %v", dp, e)
+	return nil
+}
+
+// removeMissingDeliveryPointFromServiceSubscriber repairs a single orphan
+// pointer: dpName is a member of the srv.sub-2-dp: set for (service,
+// subscriber), but its delivery.point: blob is gone. It undoes the bookkeeping
+// that AddDeliveryPointToServiceSubscriber performed, the same way
+// RemoveDeliveryPointFromServiceSubscriber would have, and logs what it did
+// so the repair is visible to an operator.
+func (r *PushRedisDB) removeMissingDeliveryPointFromServiceSubscriber(ctx context.Context, service, subscriber, dpName string, logger log.Logger) error {
+	if err := r.RemoveDeliveryPointFromServiceSubscriber(ctx, service, subscriber, dpName); err != nil {
+		return fmt.Errorf("repair of orphan delivery point %q for \"%s:%s\" failed: %v", dpName, service, subscriber, err)
+	}
+	logger.Infof("repaired orphan delivery point %q referenced by \"%s:%s\" (blob was missing)", dpName, service, subscriber)
+	return nil
+}
+
+// ScanAndRepair walks every srv.sub-2-dp: set and removes any member whose
+// delivery.point: blob no longer exists, closing the gap left by a crash
+// between the SREM and the DEL in RemoveDeliveryPointFromServiceSubscriber
+// (or a manual DEL of the blob). It is meant to be run periodically, e.g.
+// from a ticker in the caller, and stops early if ctx is canceled.
+func (r *PushRedisDB) ScanAndRepair(ctx context.Context) error {
+	keys, err := r.client.Keys(ctx, SERVICE_SUBSCRIBER_TO_DELIVERY_POINTS_PREFIX+"*").Result()
+	if err != nil {
+		return fmt.Errorf("ScanAndRepair failed to list subscriber sets: %v", err)
 	}
-	if i <= 0 {
-		_, e0 := r.client.Del(DELIVERY_POINT_COUNTER_PREFIX + dp)
-		if e0 != nil {
-			return fmt.Errorf("Failed to remove counter for %q: %v", dp, e0)
+	for _, k := range keys {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		default:
+		}
+
+		elem := strings.SplitN(strings.TrimPrefix(k, SERVICE_SUBSCRIBER_TO_DELIVERY_POINTS_PREFIX), ":", 2)
+		if len(elem) != 2 {
+			r.logger.Errorf("ScanAndRepair skipping malformed key %q", k)
+			continue
 		}
-		_, e1 := r.client.Del(DELIVERY_POINT_PREFIX + dp)
-		if e1 != nil {
-			return fmt.Errorf("Failed to remove delivery point info for %q: %v", dp, e1)
+		service, subscriber := elem[0], elem[1]
+
+		members, err := r.client.SMembers(ctx, k).Result()
+		if err != nil {
+			return fmt.Errorf("ScanAndRepair smembers %q failed: %v", k, err)
+		}
+		if len(members) == 0 {
+			continue
+		}
+
+		blobs, err := r.mgetRawDeliveryPoints(ctx, members...)
+		if err != nil {
+			return fmt.Errorf("ScanAndRepair mget for %q failed: %v", k, err)
+		}
+		for i, blob := range blobs {
+			if blob != nil {
+				continue
+			}
+			if err := r.removeMissingDeliveryPointFromServiceSubscriber(ctx, service, subscriber, members[i], r.logger); err != nil {
+				return err
+			}
 		}
 	}
 	return nil
 }
 
-func (r *PushRedisDB) SetPushServiceProviderOfServiceDeliveryPoint(srv, dp, psp string) error {
-	err := r.client.Set(SERVICE_DELIVERY_POINT_TO_PUSH_SERVICE_PROVIDER_PREFIX+srv+":"+dp, []byte(psp))
-	if err != nil {
+// SetPushServiceProviderOfServiceDeliveryPoint also registers psp under the
+// service's set of push service providers (the same effect as calling
+// AddPushServiceProviderToService), in the same round trip, so the two
+// pieces of state this PSP is known by can never fall out of sync with
+// each other.
+func (r *PushRedisDB) SetPushServiceProviderOfServiceDeliveryPoint(ctx context.Context, srv, dp, psp string) error {
+	if r.clusterMode {
+		return errClusterCrossSlot
+	}
+	keys := []string{
+		serviceDeliveryPointToPushServiceProviderKey(srv, dp),
+		serviceToPushServiceProvidersKey(srv),
+	}
+	if err := r.client.Eval(ctx, setPushServiceProviderOfServiceDeliveryPointScript, keys, psp).Err(); err != nil {
 		return fmt.Errorf("SetPSPOfServiceDP failed for \"%s:%s\": %v", srv, dp, err)
 	}
 	return nil
 }
 
-func (r *PushRedisDB) RemovePushServiceProviderOfServiceDeliveryPoint(srv, dp string) error {
-	_, err := r.client.Del(SERVICE_DELIVERY_POINT_TO_PUSH_SERVICE_PROVIDER_PREFIX + srv + ":" + dp)
-	if err != nil {
+func (r *PushRedisDB) RemovePushServiceProviderOfServiceDeliveryPoint(ctx context.Context, srv, dp string) error {
+	if err := r.client.Del(ctx, serviceDeliveryPointToPushServiceProviderKey(srv, dp)).Err(); err != nil {
 		return fmt.Errorf("RemovePSPOfServiceDP failed for \"%s:%s\": %v", srv, dp, err)
 	}
-	return err
+	return nil
 }
 
-func (r *PushRedisDB) GetPushServiceProvidersByService(srv string) ([]string, error) {
-	m, err := r.client.Smembers(SERVICE_TO_PUSH_SERVICE_PROVIDERS_PREFIX + srv)
+func (r *PushRedisDB) GetPushServiceProvidersByService(ctx context.Context, srv string) ([]string, error) {
+	m, err := r.client.SMembers(ctx, serviceToPushServiceProvidersKey(srv)).Result()
 	if err != nil {
 		return nil, fmt.Errorf("GetPSPsByService failed for %q: %v", srv, err)
 	}
-	if m == nil {
+	if len(m) == 0 {
 		return nil, nil
 	}
-	ret := make([]string, len(m))
-	for i, bm := range m {
-		ret[i] = string(bm)
-	}
-
-	return ret, nil
+	return m, nil
 }
 
-func (r *PushRedisDB) RemovePushServiceProviderFromService(srv, psp string) error {
-	_, err := r.client.Srem(SERVICE_TO_PUSH_SERVICE_PROVIDERS_PREFIX+srv, []byte(psp))
-	if err != nil {
+func (r *PushRedisDB) RemovePushServiceProviderFromService(ctx context.Context, srv, psp string) error {
+	if err := r.client.SRem(ctx, serviceToPushServiceProvidersKey(srv), psp).Err(); err != nil {
 		return fmt.Errorf("RemovePSPFromService failed for psp %q of service %q: %v", psp, srv, err)
 	}
 	return nil
 }
 
-func (r *PushRedisDB) AddPushServiceProviderToService(srv, psp string) error {
-	_, err := r.client.Sadd(SERVICE_TO_PUSH_SERVICE_PROVIDERS_PREFIX+srv, []byte(psp))
-	if err != nil {
+func (r *PushRedisDB) AddPushServiceProviderToService(ctx context.Context, srv, psp string) error {
+	if err := r.client.SAdd(ctx, serviceToPushServiceProvidersKey(srv), psp).Err(); err != nil {
 		return fmt.Errorf("AddPSPToService failed for psp %q of service %q: %v", psp, srv, err)
 	}
 	return nil
 }
 
-func (r *PushRedisDB) FlushCache() error {
-	return r.client.Save()
+// FlushCache used to call SAVE, which blocks the whole server until the
+// snapshot is written to disk. BGSAVE forks and writes in the background so
+// a flush no longer stalls every other client.
+func (r *PushRedisDB) FlushCache(ctx context.Context) error {
+	return r.client.BgSave(ctx).Err()
 }
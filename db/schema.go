@@ -0,0 +1,141 @@
+/*
+ * Copyright 2011 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package db
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"strings"
+)
+
+// The prefixes below define the key layout of a pushRawDatabase. They used
+// to live in pushredisdb.go, but every pushRawDatabase backend (Redis,
+// BoltDB, etcd, ...) has to agree on exactly the same layout for the data
+// to mean the same thing regardless of which one is configured, so they're
+// factored out here instead of being copied into each backend.
+const (
+	DELIVERY_POINT_PREFIX                                  string = "delivery.point:"         // STRING (prefix of)- Maps the delivery point name to a json blob of information about a delivery point.
+	PUSH_SERVICE_PROVIDER_PREFIX                           string = "push.service.provider:"  // STRING (prefix of) - Maps a push service provider name to a json blob of information about it.
+	SERVICE_SUBSCRIBER_TO_DELIVERY_POINTS_PREFIX           string = "srv.sub-2-dp:"           // SET (prefix of) - Maps a service name + subscriber to a set of delivery point names
+	SERVICE_DELIVERY_POINT_TO_PUSH_SERVICE_PROVIDER_PREFIX string = "srv.dp-2-psp:"           // STRING (prefix of) - Maps a service name + delivery point name to the push service provider
+	SERVICE_TO_PUSH_SERVICE_PROVIDERS_PREFIX               string = "srv-2-psp:"              // SET (prefix of) - Maps a service name to a set of PSP names
+	DELIVERY_POINT_COUNTER_PREFIX                          string = "delivery.point.counter:" // STRING (prefix of) - Maps a delivery point name to the number of subcribers(summed across each service).
+)
+
+// deliveryPointKey, pushServiceProviderKey, etc. build the full key for a
+// given prefix the same way on every backend, so two backends never disagree
+// about how a (service, subscriber) pair or a delivery point name is encoded.
+func deliveryPointKey(dp string) string {
+	return DELIVERY_POINT_PREFIX + dp
+}
+
+func pushServiceProviderKey(psp string) string {
+	return PUSH_SERVICE_PROVIDER_PREFIX + psp
+}
+
+func serviceSubscriberToDeliveryPointsKey(srv, sub string) string {
+	return SERVICE_SUBSCRIBER_TO_DELIVERY_POINTS_PREFIX + srv + ":" + sub
+}
+
+func serviceDeliveryPointToPushServiceProviderKey(srv, dp string) string {
+	return SERVICE_DELIVERY_POINT_TO_PUSH_SERVICE_PROVIDER_PREFIX + srv + ":" + dp
+}
+
+func serviceToPushServiceProvidersKey(srv string) string {
+	return SERVICE_TO_PUSH_SERVICE_PROVIDERS_PREFIX + srv
+}
+
+func deliveryPointCounterKey(dp string) string {
+	return DELIVERY_POINT_COUNTER_PREFIX + dp
+}
+
+// newPushRawDatabase dispatches to the pushRawDatabase constructor for
+// c.Engine. Each backend still validates its own engine name, since each
+// constructor is also usable directly.
+func newPushRawDatabase(c *DatabaseConfig) (pushRawDatabase, error) {
+	if c == nil {
+		return nil, errors.New("Invalid Database Config")
+	}
+	switch strings.ToLower(c.Engine) {
+	case "redis":
+		return newPushRedisDB(c)
+	case "bolt":
+		return newPushBoltDB(c)
+	case "etcd":
+		return newPushEtcdDB(c)
+	default:
+		return nil, fmt.Errorf("Unsupported Database Engine %q", c.Engine)
+	}
+}
+
+// defaultCompressionThreshold is used when DatabaseConfig.CompressionThreshold
+// is unset (zero): blobs smaller than this aren't worth the CPU it'd cost to
+// gzip them.
+const defaultCompressionThreshold = 512
+
+// gzipMagic is the two-byte header gzip always writes. A blob that doesn't
+// start with it is either uncompressed or predates compression support, so
+// maybeDecompress passes it through unchanged instead of failing to read it.
+var gzipMagic = []byte{0x1f, 0x8b}
+
+// maybeCompress gzips value when compression is enabled and value is larger
+// than threshold (falling back to defaultCompressionThreshold when threshold
+// is <= 0). It returns value unchanged otherwise, so toggling compression off
+// never makes existing data unreadable.
+func maybeCompress(value []byte, enabled bool, threshold int) []byte {
+	if !enabled {
+		return value
+	}
+	if threshold <= 0 {
+		threshold = defaultCompressionThreshold
+	}
+	if len(value) <= threshold {
+		return value
+	}
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+	if _, err := w.Write(value); err != nil {
+		return value
+	}
+	if err := w.Close(); err != nil {
+		return value
+	}
+	return buf.Bytes()
+}
+
+// maybeDecompress reverses maybeCompress. It recognizes gzip's own magic
+// bytes rather than a bespoke marker, so blobs written before compression
+// was ever enabled (which are never gzip-shaped) continue to load as-is.
+func maybeDecompress(value []byte) ([]byte, error) {
+	if len(value) < len(gzipMagic) || !bytes.HasPrefix(value, gzipMagic) {
+		return value, nil
+	}
+	gr, err := gzip.NewReader(bytes.NewReader(value))
+	if err != nil {
+		return nil, fmt.Errorf("failed to open gzip blob: %v", err)
+	}
+	defer gr.Close()
+	out, err := ioutil.ReadAll(gr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decompress gzip blob: %v", err)
+	}
+	return out, nil
+}